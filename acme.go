@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeHTTP01Addr is the side listener autocert uses to answer HTTP-01
+// challenges; ACME requires this on the well-known port 80.
+const acmeHTTP01Addr = ":80"
+
+// ACMEConfig is portalConfig's ACME section. When Enabled, start() obtains
+// and renews the TLS certificate automatically instead of reading the
+// static TLSCert/TLSCertKey config values.
+type ACMEConfig struct {
+	Enabled bool
+	Email   string
+	Domains []string
+
+	// ChallengeType is either "http-01" (a side listener on :80) or
+	// "tls-alpn-01" (answered within the TLS handshake itself).
+	ChallengeType string
+
+	// CacheDir is where issued certificates are persisted between
+	// restarts, via autocert.DirCache.
+	CacheDir string
+
+	// DirectoryURL overrides the ACME directory, e.g. to point at Let's
+	// Encrypt's staging environment in non-production deployments.
+	DirectoryURL string
+}
+
+// newACMEManager builds an autocert.Manager from the proxy's ACME config,
+// caching issued certificates on disk so they survive restarts.
+func newACMEManager(cfg ACMEConfig) *autocert.Manager {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cfg.Domains...),
+		Cache:      autocert.DirCache(cfg.CacheDir),
+		Email:      cfg.Email,
+	}
+
+	if cfg.DirectoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: cfg.DirectoryURL}
+	}
+
+	return m
+}
+
+// startACMEHTTP01Server serves the ACME HTTP-01 challenge handler on :80
+// until ctx is cancelled. It is only needed when ChallengeType is "http-01";
+// TLS-ALPN-01 is answered entirely within the TLS handshake on the main
+// listener.
+func startACMEHTTP01Server(ctx context.Context, m *autocert.Manager) {
+	srv := &http.Server{
+		Addr:    acmeHTTP01Addr,
+		Handler: m.HTTPHandler(nil),
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			appLog.Error().Err(err).Msg("ACME HTTP-01 listener shutdown error")
+		}
+	}()
+
+	appLog.Info().Msgf("ACME HTTP-01 challenge listener starting on %s", acmeHTTP01Addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		appLog.Error().Err(err).Msg("ACME HTTP-01 challenge listener error")
+	}
+}
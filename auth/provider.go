@@ -0,0 +1,48 @@
+// Package auth defines the pluggable identity-provider interface used to
+// authenticate users against either UAA or a generic OIDC issuer.
+package auth
+
+import "context"
+
+// UserInfo is the normalized set of claims the proxy cares about, regardless
+// of which IdentityProvider produced them.
+type UserInfo struct {
+	Subject string
+	Email   string
+	Groups  []string
+}
+
+// Token is the normalized token pair handed back from an OAuth2 code
+// exchange.
+type Token struct {
+	AccessToken  string
+	RefreshToken string
+	RawIDToken   string
+}
+
+// IdentityProvider is the shape a login backend needs to implement to be
+// driven uniformly by registerRoutes. OIDCProvider is the only concrete
+// implementation so far: UAA login (p.loginToUAA, registered directly on
+// "/v1/auth/login/uaa") predates this interface, is a resource-owner
+// password flow rather than OIDC's authorization-code redirect/callback
+// shape, and isn't adapted to it yet. Wiring UAA through IdentityProvider
+// is tracked as follow-up work, not implied by this interface's existence.
+type IdentityProvider interface {
+	// Name identifies the provider, e.g. "uaa" or "oidc", for logging and
+	// for the session claims that record how a user authenticated.
+	Name() string
+
+	// RedirectURL builds the authorization endpoint URL the browser
+	// should be sent to, encoding state for CSRF protection.
+	RedirectURL(state string) string
+
+	// Exchange swaps an authorization code for tokens.
+	Exchange(ctx context.Context, code string) (Token, error)
+
+	// UserInfo resolves the authenticated user's profile from a token.
+	UserInfo(ctx context.Context, token Token) (UserInfo, error)
+
+	// Verify checks a raw ID token's signature and claims against the
+	// provider's published keys and returns the claims it asserts.
+	Verify(ctx context.Context, rawIDToken string) (UserInfo, error)
+}
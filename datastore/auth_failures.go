@@ -0,0 +1,85 @@
+package datastore
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"time"
+)
+
+// authFailureLockoutBase is the backoff unit: the Nth consecutive failure
+// locks the username out for base * 2^(N-lockoutThreshold) (1, 2, 4, ...
+// minutes), once N reaches lockoutThreshold.
+const (
+	authFailureLockoutThreshold = 5
+	authFailureLockoutBase      = time.Minute
+)
+
+// EnsureAuthFailuresTable provisions the auth_failures table if it doesn't
+// already exist. Called once at startup, the same way the session store
+// provisions http_sessions.
+func EnsureAuthFailuresTable(db *sql.DB, dialect Dialect) error {
+	_, err := db.Exec(dialect.AuthFailuresDDL())
+	return err
+}
+
+// RecordAuthFailure increments the failure count for username, creating its
+// auth_failures row if this is the first failure seen. Call this from the
+// UAA login handler whenever a login attempt is rejected.
+func RecordAuthFailure(db *sql.DB, dialect Dialect, username string) error {
+	insertSQL := fmt.Sprintf(
+		"INSERT INTO auth_failures (username, failure_count, last_failure_at) VALUES (%s, 1, %s)",
+		dialect.Placeholder(1), nowLiteral(dialect))
+	upsertSQL := dialect.UpsertSQL(insertSQL, "username",
+		fmt.Sprintf("failure_count = auth_failures.failure_count + 1, last_failure_at = %s", nowLiteral(dialect)))
+
+	_, err := db.Exec(upsertSQL, username)
+	return err
+}
+
+// ResetAuthFailures clears username's failure count after a successful
+// login.
+func ResetAuthFailures(db *sql.DB, dialect Dialect, username string) error {
+	_, err := db.Exec(fmt.Sprintf("DELETE FROM auth_failures WHERE username = %s", dialect.Placeholder(1)), username)
+	return err
+}
+
+// AuthFailureLockedUntil returns the time at which username's lockout (if
+// any) expires. A zero time.Time means the username isn't currently locked
+// out.
+func AuthFailureLockedUntil(db *sql.DB, dialect Dialect, username string) (time.Time, error) {
+	var failureCount int
+	var lastFailureAt time.Time
+
+	query := fmt.Sprintf("SELECT failure_count, last_failure_at FROM auth_failures WHERE username = %s", dialect.Placeholder(1))
+	row := db.QueryRow(query, username)
+	if err := row.Scan(&failureCount, &lastFailureAt); err != nil {
+		if err == sql.ErrNoRows {
+			return time.Time{}, nil
+		}
+		return time.Time{}, err
+	}
+
+	return authFailureLockoutExpiry(failureCount, lastFailureAt), nil
+}
+
+// authFailureLockoutExpiry computes the backoff math in isolation from the
+// database lookup above, so it can be unit tested without a connection.
+func authFailureLockoutExpiry(failureCount int, lastFailureAt time.Time) time.Time {
+	if failureCount < authFailureLockoutThreshold {
+		return time.Time{}
+	}
+
+	backoff := time.Duration(math.Pow(2, float64(failureCount-authFailureLockoutThreshold))) * authFailureLockoutBase
+	return lastFailureAt.Add(backoff)
+}
+
+// nowLiteral returns this dialect's SQL for "the current timestamp",
+// sidestepping a bound parameter since neither Postgres nor SQLite need one
+// for it.
+func nowLiteral(dialect Dialect) string {
+	if _, ok := dialect.(sqliteDialect); ok {
+		return "CURRENT_TIMESTAMP"
+	}
+	return "now()"
+}
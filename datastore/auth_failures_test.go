@@ -0,0 +1,30 @@
+package datastore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAuthFailureLockoutExpiry(t *testing.T) {
+	lastFailureAt := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name         string
+		failureCount int
+		want         time.Time
+	}{
+		{"below threshold is not locked out", authFailureLockoutThreshold - 1, time.Time{}},
+		{"at threshold locks out for the base duration", authFailureLockoutThreshold, lastFailureAt.Add(authFailureLockoutBase)},
+		{"one failure past threshold doubles the backoff", authFailureLockoutThreshold + 1, lastFailureAt.Add(2 * authFailureLockoutBase)},
+		{"three failures past threshold is an 8x backoff", authFailureLockoutThreshold + 3, lastFailureAt.Add(8 * authFailureLockoutBase)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := authFailureLockoutExpiry(tt.failureCount, lastFailureAt)
+			if !got.Equal(tt.want) {
+				t.Errorf("authFailureLockoutExpiry(%d, ...) = %v, want %v", tt.failureCount, got, tt.want)
+			}
+		})
+	}
+}
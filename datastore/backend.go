@@ -0,0 +1,143 @@
+package datastore
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/fergusstrange/embedded-postgres"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// DatabaseBackend identifies which SQL engine DatabaseConfig.Backend selects.
+// postgres remains the default for production deployments; sqlite3 and
+// embedded-postgres exist so the proxy can be built and tested without a
+// standalone Postgres server.
+type DatabaseBackend string
+
+const (
+	// BackendPostgres talks to an externally managed Postgres server, as
+	// the proxy has always done.
+	BackendPostgres DatabaseBackend = "postgres"
+	// BackendSQLite opens a local SQLite file, for dev/test use only.
+	BackendSQLite DatabaseBackend = "sqlite3"
+	// BackendEmbeddedPostgres launches a throwaway Postgres instance
+	// managed by the proxy process itself, for dev/test use only.
+	BackendEmbeddedPostgres DatabaseBackend = "embedded-postgres"
+)
+
+// Dialect captures the SQL differences between backends that the rest of
+// the proxy needs to know about: placeholder style, upsert syntax, and the
+// DDL used to create the login-lockout table. The session store itself
+// isn't part of this: pgstore provisions its own Postgres table, and the
+// sqlite3 backend pairs with sessions.NewFilesystemStore instead, which
+// needs no table at all.
+type Dialect interface {
+	// Placeholder returns the parameter placeholder for the nth (1-based)
+	// bind argument in a query, e.g. "$1" for Postgres or "?" for SQLite.
+	Placeholder(n int) string
+	// UpsertSQL wraps an INSERT statement with this dialect's
+	// insert-or-update syntax for the given conflict target.
+	UpsertSQL(insertSQL, conflictTarget, updateSQL string) string
+	// AuthFailuresDDL returns the CREATE TABLE statement used to
+	// provision the login-lockout tracking table.
+	AuthFailuresDDL() string
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) Placeholder(n int) string { return fmt.Sprintf("$%d", n) }
+
+func (postgresDialect) UpsertSQL(insertSQL, conflictTarget, updateSQL string) string {
+	return fmt.Sprintf("%s ON CONFLICT (%s) DO UPDATE SET %s", insertSQL, conflictTarget, updateSQL)
+}
+
+func (postgresDialect) AuthFailuresDDL() string {
+	return `CREATE TABLE IF NOT EXISTS auth_failures (
+		username TEXT PRIMARY KEY,
+		failure_count INTEGER NOT NULL DEFAULT 0,
+		last_failure_at TIMESTAMPTZ NOT NULL
+	)`
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Placeholder(n int) string { return "?" }
+
+func (sqliteDialect) UpsertSQL(insertSQL, conflictTarget, updateSQL string) string {
+	return fmt.Sprintf("%s ON CONFLICT (%s) DO UPDATE SET %s", insertSQL, conflictTarget, updateSQL)
+}
+
+func (sqliteDialect) AuthFailuresDDL() string {
+	return `CREATE TABLE IF NOT EXISTS auth_failures (
+		username TEXT PRIMARY KEY,
+		failure_count INTEGER NOT NULL DEFAULT 0,
+		last_failure_at DATETIME NOT NULL
+	)`
+}
+
+// embeddedPG holds the running embedded Postgres instance, when one was
+// started, so Open's caller can shut it down alongside the connection pool.
+var embeddedPG *embeddedpostgres.EmbeddedPostgres
+
+// Open establishes a connection pool for the backend named in dc.Backend,
+// returning the pool alongside a Dialect that callers use for any
+// backend-specific SQL. DatabaseBackend defaults to postgres when unset, to
+// match every config that predates this field.
+func Open(dc DatabaseConfig) (*sql.DB, Dialect, error) {
+	backend := dc.Backend
+	if backend == "" {
+		backend = BackendPostgres
+	}
+
+	switch backend {
+	case BackendPostgres:
+		pool, err := GetConnection(dc)
+		return pool, postgresDialect{}, err
+
+	case BackendSQLite:
+		pool, err := sql.Open("sqlite3", dc.SQLiteFilePath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unable to open sqlite3 database %q: %v", dc.SQLiteFilePath, err)
+		}
+		// mattn/go-sqlite3 serializes writes at the file level, so handing
+		// out more than one connection under database/sql just produces
+		// intermittent "database is locked" errors under concurrent writers.
+		pool.SetMaxOpenConns(1)
+		return pool, sqliteDialect{}, nil
+
+	case BackendEmbeddedPostgres:
+		pg := embeddedpostgres.NewDatabase(embeddedpostgres.DefaultConfig().
+			Username(dc.Username).
+			Password(dc.Password).
+			Database(dc.Database).
+			Port(uint32(dc.Port)))
+		if err := pg.Start(); err != nil {
+			return nil, nil, fmt.Errorf("Unable to start embedded Postgres: %v", err)
+		}
+		embeddedPG = pg
+
+		// embedded-postgres always binds to localhost, regardless of
+		// whatever Host the ambient database config carries, so the
+		// connection parameters must follow suit or GetConnection dials
+		// the wrong address.
+		dc.Host = "127.0.0.1"
+		pool, err := GetConnection(dc)
+		if err != nil {
+			pg.Stop()
+			return nil, nil, err
+		}
+		return pool, postgresDialect{}, nil
+
+	default:
+		return nil, nil, fmt.Errorf("Unknown database backend: %q", backend)
+	}
+}
+
+// StopEmbedded shuts down the embedded Postgres instance started by Open,
+// if any. It is a no-op when the backend was postgres or sqlite3.
+func StopEmbedded() error {
+	if embeddedPG == nil {
+		return nil
+	}
+	return embeddedPG.Stop()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo"
+	"github.com/rs/zerolog"
+)
+
+// accessLogMiddleware is a structured replacement for echo's built-in
+// middleware.Logger(), which always writes a fixed plain-text line to
+// stdout regardless of LogFormat. Routing the access log through appLog
+// keeps it in the same JSON/human format as every other log line, and
+// carries request_id so an access log entry can be correlated with
+// whatever else was logged while handling it.
+func accessLogMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+
+		appLog.Info().
+			Str("request_id", requestIDFromContext(c)).
+			Str("method", c.Request().Method()).
+			Str("route", c.Path()).
+			Int("status", c.Response().Status()).
+			Dur("latency", time.Since(start)).
+			Msg("request")
+
+		return err
+	}
+}
+
+// requestIDHeader is both the header the proxy looks for on inbound
+// requests (so callers can supply their own correlation ID) and the one it
+// stamps on every response.
+const requestIDHeader = "X-Request-ID"
+
+// requestIDContextKey is the echo.Context key the request ID is stored
+// under for the lifetime of a request.
+const requestIDContextKey = "request_id"
+
+// appLog is the process-wide structured logger. It defaults to a
+// human-readable console writer so early startup (before portalConfig is
+// loaded) still reads well; main() reconfigures it once LogFormat/LogLevel
+// are known.
+var appLog = newLogger("human", "info")
+
+// newLogger builds a zerolog.Logger using either a JSON encoder (for
+// aggregation in ELK/Loki) or a human-readable console writer, selected by
+// portalConfig.LogFormat. An unrecognized level falls back to info.
+func newLogger(format, level string) zerolog.Logger {
+	var output io.Writer = os.Stdout
+	if format != "json" {
+		output = zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339}
+	}
+
+	lvl, err := zerolog.ParseLevel(level)
+	if err != nil || lvl == zerolog.NoLevel {
+		lvl = zerolog.InfoLevel
+	}
+
+	return zerolog.New(output).Level(lvl).With().Timestamp().Logger()
+}
+
+// requestIDMiddleware assigns every request a correlation ID (reusing one
+// supplied via X-Request-ID, so upstream load balancers/gateways can
+// propagate their own), stamps it on the response, and stores it on the
+// echo.Context under requestIDContextKey. Only log lines that read it back
+// via requestIDFromContext, such as accessLogMiddleware's, carry it; other
+// appLog calls made while handling the request do not.
+func requestIDMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		reqID := c.Request().Header().Get(requestIDHeader)
+		if reqID == "" {
+			reqID = uuid.New().String()
+		}
+
+		c.Set(requestIDContextKey, reqID)
+		c.Response().Header().Set(requestIDHeader, reqID)
+
+		return next(c)
+	}
+}
+
+// requestIDFromContext retrieves the current request's correlation ID.
+//
+// FOLLOW-UP: end-to-end tracing through a proxied CNSI call needs p.proxy
+// and p.vcsProxy to forward this value upstream on the outbound request,
+// the same way they already copy the caller's Authorization header. Neither
+// handler is defined in this series, so that forwarding is not yet wired up
+// anywhere — this only covers the request ID on the proxy's own response.
+func requestIDFromContext(c echo.Context) string {
+	id, _ := c.Get(requestIDContextKey).(string)
+	return id
+}
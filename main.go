@@ -1,12 +1,12 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"database/sql"
 	"encoding/hex"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
 	"os/signal"
@@ -14,14 +14,20 @@ import (
 	"time"
 
 	"github.com/antonlindstrom/pgstore"
+	"github.com/gorilla/sessions"
+	"github.com/hpcloud/portal-proxy/auth"
 	"github.com/hpcloud/portal-proxy/datastore"
 	"github.com/hpcloud/portal-proxy/repository/tokens"
 	"github.com/hpcloud/ucpconfig"
 	"github.com/labstack/echo"
-	"github.com/labstack/echo/engine/standard"
 	"github.com/labstack/echo/middleware"
+	"golang.org/x/sync/errgroup"
 )
 
+// DefaultHTTPShutdownTimeout is used when portalConfig.HTTPShutdownTimeout is
+// not set, giving in-flight requests a reasonable window to finish draining.
+const DefaultHTTPShutdownTimeout = 5 * time.Second
+
 // TimeoutBoundary represents the amount of time we'll wait for the database
 // server to come online before we bail out.
 const TimeoutBoundary = 10
@@ -30,100 +36,128 @@ var (
 	httpClient = http.Client{}
 )
 
-func cleanup(dbc *sql.DB, ss *pgstore.PGStore) {
-	log.Println("Attempting to shut down gracefully...")
-	log.Println(`--- Closing databaseConnectionPool`)
+func cleanup(dbc *sql.DB, ss sessions.Store) {
+	// Closed in the reverse order they were initialized: the session store
+	// sits on top of the database connection pool, so it must go first.
+	appLog.Debug().Msg("Attempting to shut down gracefully...")
+	if pg, ok := ss.(*pgstore.PGStore); ok {
+		appLog.Debug().Msg(`--- Closing sessionStore`)
+		pg.Close()
+		appLog.Debug().Msg(`--- Stopping sessionStore cleanup`)
+		pg.StopCleanup(pg.Cleanup(time.Minute * 5))
+	}
+	appLog.Debug().Msg(`--- Closing databaseConnectionPool`)
 	dbc.Close()
-	log.Println(`--- Closing sessionStore`)
-	ss.Close()
-	log.Println(`--- Stopping sessionStore cleanup`)
-	ss.StopCleanup(ss.Cleanup(time.Minute * 5))
-	log.Println("Graceful shut down complete")
+	appLog.Debug().Msg(`--- Stopping embedded database, if any`)
+	if err := datastore.StopEmbedded(); err != nil {
+		appLog.Error().Err(err).Msg("Error stopping embedded database")
+	}
+	appLog.Debug().Msg("Graceful shut down complete")
 }
 
 func main() {
-	log.SetOutput(os.Stdout)
-	log.Println("Proxy initialization started.")
+	appLog.Info().Msg("Proxy initialization started.")
 
 	// Load the portal configuration from env vars via ucpconfig
 	var portalConfig portalConfig
 	portalConfig, err := loadPortalConfig(portalConfig)
 	if err != nil {
-		log.Println(err)
+		appLog.Error().Err(err).Msg("Fatal error during startup")
 		os.Exit(1)
 	}
-	log.Println("Proxy configuration loaded.")
+	appLog = newLogger(portalConfig.LogFormat, portalConfig.LogLevel)
+	appLog.Info().Msg("Proxy configuration loaded.")
 
 	// Initialize the HTTP client
 	initializeHTTPClient(portalConfig.SkipTLSVerification,
 		time.Duration(portalConfig.HTTPClientTimeoutInSecs)*time.Second)
-	log.Println("HTTP client initialized.")
+	appLog.Info().Msg("HTTP client initialized.")
 
 	// Get the encryption key we need for tokens in the database
 	portalConfig.EncryptionKeyInBytes, err = getEncryptionKey(portalConfig)
 	if err != nil {
-		log.Println(err)
+		appLog.Error().Err(err).Msg("Fatal error during startup")
 		os.Exit(1)
 	}
-	log.Println("Encryption key set.")
+	appLog.Info().Msg("Encryption key set.")
 
 	portalConfig.VCSClientMap, err = getVCSClients(portalConfig)
 	if err != nil {
-		log.Println("Error parsing VCS clients")
+		appLog.Info().Msg("Error parsing VCS clients")
 	}
 
-	// Establish a Postgresql connection pool
+	// Establish the database connection pool for the configured backend
 	var databaseConnectionPool *sql.DB
-	databaseConnectionPool, err = initConnPool()
+	var dbDialect datastore.Dialect
+	databaseConnectionPool, dbDialect, err = initConnPool()
 	if err != nil {
-		log.Println(err)
+		appLog.Error().Err(err).Msg("Fatal error during startup")
 		os.Exit(1)
 	}
-	defer func() {
-		log.Println(`--- Closing databaseConnectionPool`)
-		databaseConnectionPool.Close()
-	}()
-	log.Println("Proxy database connection pool created.")
+	appLog.Info().Msg("Proxy database connection pool created.")
 
 	// Initialize the Postgres backed session store for Gorilla sessions
 	sessionStore, err := initSessionStore(databaseConnectionPool, portalConfig)
 	if err != nil {
-		log.Println(err)
+		appLog.Error().Err(err).Msg("Fatal error during startup")
 		os.Exit(1)
 	}
-	defer func() {
-		log.Println(`--- Closing sessionStore`)
-		sessionStore.Close()
-	}()
-	defer func() {
-		log.Println(`--- Setting up sessionStore cleanup`)
-		sessionStore.StopCleanup(sessionStore.Cleanup(time.Minute * 5))
-	}()
-	log.Println("Proxy session store initialized.")
+	appLog.Info().Msg("Proxy session store initialized.")
+	// databaseConnectionPool and sessionStore are closed together by
+	// cleanup() once start() returns, in the reverse order of init.
 
 	// Setup the global interface for the proxy
-	portalProxy := newPortalProxy(portalConfig, databaseConnectionPool, sessionStore)
-	log.Println("Proxy initialization complete.")
+	portalProxy := newPortalProxy(portalConfig, databaseConnectionPool, dbDialect, sessionStore)
+	appLog.Info().Msg("Proxy initialization complete.")
+
+	if portalConfig.OIDCIssuerURL != "" {
+		oidcProvider, err := auth.NewOIDCProvider(context.Background(), auth.OIDCConfig{
+			IssuerURL:     portalConfig.OIDCIssuerURL,
+			ClientID:      portalConfig.OIDCClientID,
+			ClientSecret:  portalConfig.OIDCClientSecret,
+			RedirectURL:   portalConfig.OIDCRedirectURL,
+			Scopes:        portalConfig.OIDCScopes,
+			AllowedGroups: portalConfig.OIDCAllowedGroups,
+		})
+		if err != nil {
+			appLog.Error().Err(err).Msg("Fatal error during startup")
+			os.Exit(1)
+		}
+		portalProxy.OIDCProvider = oidcProvider
+		appLog.Info().Msg("OIDC identity provider configured.")
+	}
 
+	// Admin listener (Prometheus /metrics + /debug/pprof) lives on its own
+	// address so it is never exposed on the public TLS port.
+	adminCtx, stopAdminServer := context.WithCancel(context.Background())
+	defer stopAdminServer()
+	go startAdminServer(adminCtx, portalConfig.MetricsAddress, portalProxy.Metrics)
+
+	// On SIGTERM/SIGINT, cancel the server context so start() stops
+	// accepting new connections and drains in-flight requests before
+	// returning, rather than killing them outright via os.Exit.
+	ctx, cancel := context.WithCancel(context.Background())
 	c := make(chan os.Signal, 2)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
-		cleanup(databaseConnectionPool, sessionStore)
-		os.Exit(1)
+		appLog.Info().Msg("Shutdown signal received.")
+		cancel()
 	}()
 
 	// Start the proxy
-	log.Println("Proxy config at startup")
-	log.Printf("%+v\n", portalConfig)
-	if err := start(portalProxy); err != nil {
-		log.Printf("Unable to start the proxy: %v", err)
+	appLog.Info().Interface("config", portalConfig).Msg("Proxy config at startup")
+	if err := start(ctx, portalProxy); err != nil {
+		appLog.Error().Err(err).Msg("Unable to start the proxy")
+		cleanup(databaseConnectionPool, sessionStore)
 		os.Exit(1)
 	}
+
+	cleanup(databaseConnectionPool, sessionStore)
 }
 
 func getEncryptionKey(pc portalConfig) ([]byte, error) {
-	log.Println("getEncryptionKey")
+	appLog.Debug().Msg("getEncryptionKey")
 
 	// If it exists in "EncryptionKey" we must be in compose; use it.
 	if len(pc.EncryptionKey) > 0 {
@@ -138,58 +172,71 @@ func getEncryptionKey(pc portalConfig) ([]byte, error) {
 	// Read the key from the shared volume
 	key, err := tokens.ReadKey(pc.EncryptionKeyVolume, pc.EncryptionKeyFilename)
 	if err != nil {
-		log.Printf("Unable to read the encryption key from the shared volume: %v", err)
+		appLog.Error().Err(err).Msg("Unable to read the encryption key from the shared volume")
 		return nil, err
 	}
 
 	return key, nil
 }
 
-func initConnPool() (*sql.DB, error) {
-	log.Println("initConnPool")
+func initConnPool() (*sql.DB, datastore.Dialect, error) {
+	appLog.Debug().Msg("initConnPool")
 
-	// load up postgresql database configuration
+	// load up the database configuration; Backend defaults to postgres
 	var dc datastore.DatabaseConfig
 	dc, err := loadDatabaseConfig(dc)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	// initialize the database connection pool
-	var pool *sql.DB
-	pool, err = datastore.GetConnection(dc)
+	// open the connection pool for whichever backend is configured
+	pool, dialect, err := datastore.Open(dc)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	// Ensure Postgres is responsive
-	for {
-
+	// SQLite and embedded-postgres are always available as soon as Open
+	// returns; only an external Postgres server needs to be waited on.
+	if dc.Backend == "" || dc.Backend == datastore.BackendPostgres {
 		// establish an outer timeout boundary
 		timeout := time.Now().Add(time.Minute * TimeoutBoundary)
-
-		// Ping Postgres
-		err = datastore.Ping(pool)
-		if err == nil {
-			log.Println("Database appears to now be available.")
-			break
-		}
-
-		// If our timeout boundary has been exceeded, bail out
-		if timeout.Sub(time.Now()) < 0 {
-			return nil, fmt.Errorf("Timeout boundary of %d minutes has been exceeded. Exiting.", TimeoutBoundary)
+		for {
+			// Ping Postgres
+			err = datastore.Ping(pool)
+			if err == nil {
+				appLog.Info().Msg("Database appears to now be available.")
+				break
+			}
+
+			// If our timeout boundary has been exceeded, bail out
+			if timeout.Sub(time.Now()) < 0 {
+				return nil, nil, fmt.Errorf("Timeout boundary of %d minutes has been exceeded. Exiting.", TimeoutBoundary)
+			}
+
+			// Circle back and try again
+			appLog.Debug().Err(err).Msg("Waiting for Postgres to be responsive")
+			time.Sleep(time.Second)
 		}
+	}
 
-		// Circle back and try again
-		log.Printf("Waiting for Postgres to be responsive: %+v\n", err)
-		time.Sleep(time.Second)
+	if err := datastore.EnsureAuthFailuresTable(pool, dialect); err != nil {
+		return nil, nil, fmt.Errorf("Unable to provision auth_failures table: %v", err)
 	}
 
-	return pool, nil
+	return pool, dialect, nil
 }
 
-func initSessionStore(db *sql.DB, pc portalConfig) (*pgstore.PGStore, error) {
-	log.Println("initSessionStore")
+// initSessionStore picks the Gorilla sessions.Store implementation that
+// matches the configured database backend: pgstore against the shared pool
+// for postgres/embedded-postgres, or a local filesystem store for sqlite3
+// dev/test setups where a Postgres-backed session table isn't available.
+func initSessionStore(db *sql.DB, pc portalConfig) (sessions.Store, error) {
+	appLog.Debug().Msg("initSessionStore")
+
+	if pc.DatabaseConfig.Backend == datastore.BackendSQLite {
+		return sessions.NewFilesystemStore(pc.SessionStoreFilesystemPath, []byte(pc.SessionStoreSecret)), nil
+	}
+
 	store, err := pgstore.NewPGStoreFromPool(db, []byte(pc.SessionStoreSecret))
 	if err != nil {
 		return nil, err
@@ -199,7 +246,7 @@ func initSessionStore(db *sql.DB, pc portalConfig) (*pgstore.PGStore, error) {
 }
 
 func loadPortalConfig(pc portalConfig) (portalConfig, error) {
-	log.Println("loadPortalConfig")
+	appLog.Debug().Msg("loadPortalConfig")
 	if err := ucpconfig.Load(&pc); err != nil {
 		return pc, fmt.Errorf("Unable to load portal configuration. %v", err)
 	}
@@ -207,25 +254,25 @@ func loadPortalConfig(pc portalConfig) (portalConfig, error) {
 }
 
 func loadDatabaseConfig(dc datastore.DatabaseConfig) (datastore.DatabaseConfig, error) {
-	log.Println("loadDatabaseConfig")
+	appLog.Debug().Msg("loadDatabaseConfig")
 	if err := ucpconfig.Load(&dc); err != nil {
 		return dc, fmt.Errorf("Unable to load database configuration. %v", err)
 	}
 
-	log.Printf("Database Config: %+v\n", dc)
+	appLog.Debug().Interface("databaseConfig", dc).Msg("Database Config")
 
 	dc, err := datastore.NewDatabaseConnectionParametersFromConfig(dc)
 	if err != nil {
 		return dc, fmt.Errorf("Unable to load database configuration. %v", err)
 	}
 
-	log.Printf("Database Config: %+v\n", dc)
+	appLog.Debug().Interface("databaseConfig", dc).Msg("Database Config")
 
 	return dc, nil
 }
 
 func createTempCertFiles(pc portalConfig) (string, string, error) {
-	log.Println("createTempCertFiles")
+	appLog.Debug().Msg("createTempCertFiles")
 	certFilename := "pproxy.crt"
 	certKeyFilename := "pproxy.key"
 
@@ -251,19 +298,21 @@ func createTempCertFiles(pc portalConfig) (string, string, error) {
 	return certFilename, certKeyFilename, nil
 }
 
-func newPortalProxy(pc portalConfig, dcp *sql.DB, ss *pgstore.PGStore) *portalProxy {
-	log.Println("newPortalProxy")
+func newPortalProxy(pc portalConfig, dcp *sql.DB, dialect datastore.Dialect, ss sessions.Store) *portalProxy {
+	appLog.Debug().Msg("newPortalProxy")
 	pp := &portalProxy{
 		Config:                 pc,
 		DatabaseConnectionPool: dcp,
+		DatabaseDialect:        dialect,
 		SessionStore:           ss,
+		Metrics:                newAppMetrics(dcp),
 	}
 
 	return pp
 }
 
 func initializeHTTPClient(skipCertVerification bool, timeoutInSeconds time.Duration) {
-	log.Println("initializeHTTPClient")
+	appLog.Debug().Msg("initializeHTTPClient")
 	tr := &http.Transport{Proxy: http.ProxyFromEnvironment}
 	if skipCertVerification {
 		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
@@ -272,14 +321,16 @@ func initializeHTTPClient(skipCertVerification bool, timeoutInSeconds time.Durat
 	httpClient.Timeout = time.Second * timeoutInSeconds
 }
 
-func start(p *portalProxy) error {
-	log.Println("start")
+func start(ctx context.Context, p *portalProxy) error {
+	appLog.Debug().Msg("start")
 	e := echo.New()
 
 	// Root level middleware
+	e.Use(requestIDMiddleware)
 	e.Use(sessionCleanupMiddleware)
-	e.Use(middleware.Logger())
+	e.Use(accessLogMiddleware)
 	e.Use(middleware.Recover())
+	e.Use(metricsMiddleware(p.Metrics))
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
 		AllowOrigins:     p.Config.AllowedOrigins,
 		AllowMethods:     []string{echo.GET, echo.PUT, echo.POST, echo.DELETE},
@@ -290,28 +341,75 @@ func start(p *portalProxy) error {
 
 	p.registerRoutes(e)
 
-	certFile, certKeyFile, err := createTempCertFiles(p.Config)
-	if err != nil {
-		return err
+	srv := &http.Server{
+		Addr:    p.Config.TLSAddress,
+		Handler: e,
+	}
+
+	shutdownTimeout := time.Duration(p.Config.HTTPShutdownTimeout) * time.Second
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = DefaultHTTPShutdownTimeout
 	}
 
-	engine := standard.WithTLS(p.Config.TLSAddress, certFile, certKeyFile)
-	e.Run(engine)
+	// certFile/certKeyFile stay empty when ACME is enabled: the manager's
+	// GetCertificate hook supplies certs from its on-disk cache instead.
+	var certFile, certKeyFile string
+	if p.Config.ACME.Enabled {
+		m := newACMEManager(p.Config.ACME)
+		srv.TLSConfig = m.TLSConfig()
 
-	return nil
+		if p.Config.ACME.ChallengeType == "http-01" {
+			go startACMEHTTP01Server(ctx, m)
+		}
+	} else {
+		var err error
+		certFile, certKeyFile, err = createTempCertFiles(p.Config)
+		if err != nil {
+			return err
+		}
+	}
+
+	// g's context is cancelled both by an external shutdown (ctx, the
+	// parent) and by the listener goroutine returning an error, so a
+	// startup failure (bad cert, port already bound, ...) unblocks the
+	// drain goroutine below instead of leaving it waiting on SIGTERM
+	// forever.
+	g, gCtx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		appLog.Info().Msgf("Listening for TLS connections on %s", p.Config.TLSAddress)
+		if err := srv.ListenAndServeTLS(certFile, certKeyFile); err != nil && err != http.ErrServerClosed {
+			return err
+		}
+		return nil
+	})
+	g.Go(func() error {
+		<-gCtx.Done()
+		appLog.Info().Msg("Draining in-flight requests before shutting down...")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		return srv.Shutdown(shutdownCtx)
+	})
+
+	return g.Wait()
 }
 
 func (p *portalProxy) registerRoutes(e *echo.Echo) {
-	log.Println("registerRoutes")
+	appLog.Debug().Msg("registerRoutes")
 
-	e.POST("/v1/auth/login/uaa", p.loginToUAA)
-	e.POST("/v1/auth/logout", p.logout)
+	// Auth endpoints share one rate limiter instance so the per-IP budget
+	// in AuthRateLimitPerIP is enforced across all of them, not per route.
+	authRateLimit := authRateLimitMiddleware(p)
+
+	authGroup := e.Group("/v1/auth")
+	authGroup.Use(authRateLimit)
+	authGroup.POST("/login/uaa", p.loginToUAA, usernameLockoutMiddleware(p))
+	authGroup.POST("/logout", p.logout)
 
 	sessionGroup := e.Group("/v1")
 	sessionGroup.Use(p.sessionMiddleware)
 
 	// Connect to HCF cluster
-	sessionGroup.POST("/auth/login/cnsi", p.loginToCNSI)
+	sessionGroup.POST("/auth/login/cnsi", p.loginToCNSI, authRateLimit)
 
 	// Disconnect HCF cluster
 	sessionGroup.POST("/auth/logout/cnsi", p.logoutOfCNSI)
@@ -332,14 +430,20 @@ func (p *portalProxy) registerRoutes(e *echo.Echo) {
 	// Version info
 	sessionGroup.GET("/version", p.getVersions)
 
+	// OIDC login, alongside UAA, on the pre-session public group
+	e.GET("/v1/auth/login/oidc", p.handleOIDCLogin)
+	e.GET("/v1/auth/callback/oidc", p.handleOIDCCallback)
+
 	// VCS Requests
 	vcsGroup := sessionGroup.Group("/vcs")
 
 	// Initiate OAuth flow against VCS on behalf of a user
 	vcsGroup.GET("/oauth/auth", p.handleVCSAuth)
 
-	// VCS OAuth callback/response
-	vcsGroup.GET("/oauth/callback", p.handleVCSAuthCallback)
+	// VCS OAuth callback/response. This URL is registered as the redirect_uri
+	// with each external VCS OAuth app (GitHub/GitLab/...), so its shape is
+	// part of the wire API and can't change to carry a per-client path param.
+	vcsGroup.GET("/oauth/callback", p.handleVCSAuthCallback, vcsOAuthMetricsMiddleware(p.Metrics))
 
 	// List VCS clients
 	vcsGroup.GET("/clients", p.listVCSClients)
@@ -357,7 +461,10 @@ func (p *portalProxy) registerRoutes(e *echo.Echo) {
 	// The admin-only routes need to be last as the admin middleware will be
 	// applied to any routes below it's instantiation
 	adminGroup := sessionGroup
-	adminGroup.Use(p.stackatoAdminMiddleware)
+	// oidcAdminGroupMiddleware subsumes stackatoAdminMiddleware: it admin-gates
+	// OIDC sessions itself (stackatoAdminMiddleware only understands UAA admin
+	// scopes) and defers to stackatoAdminMiddleware for everything else.
+	adminGroup.Use(oidcAdminGroupMiddleware(p))
 	// Register clusters
 	adminGroup.POST("/register/hcf", p.registerHCFCluster)
 	adminGroup.POST("/register/hce", p.registerHCECluster)
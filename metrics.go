@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// appMetrics bundles the Prometheus collectors for the proxy. It is attached
+// to portalProxy so route handlers and background goroutines can record
+// against a single registry.
+type appMetrics struct {
+	Registry *prometheus.Registry
+
+	httpRequests    *prometheus.CounterVec
+	httpDuration    *prometheus.HistogramVec
+	vcsOAuth        *prometheus.CounterVec
+	oidcLogins      *prometheus.CounterVec
+	authRateLimited *prometheus.CounterVec
+}
+
+// newAppMetrics builds a fresh Prometheus registry and registers the proxy's
+// collectors, including the Go/process defaults and the database connection
+// pool gauges.
+func newAppMetrics(dcp *sql.DB) *appMetrics {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(prometheus.NewGoCollector())
+	registry.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+
+	m := &appMetrics{
+		Registry: registry,
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "portal_proxy",
+			Name:      "http_requests_total",
+			Help:      "Count of HTTP requests handled by the proxy, by route and status code.",
+		}, []string{"route", "method", "status"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "portal_proxy",
+			Name:      "http_request_duration_seconds",
+			Help:      "Latency of HTTP requests handled by the proxy, by route.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		vcsOAuth: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "portal_proxy",
+			Name:      "vcs_oauth_total",
+			Help:      "Count of VCS OAuth exchanges, by client and result.",
+		}, []string{"client", "result"}),
+		oidcLogins: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "portal_proxy",
+			Name:      "oidc_logins_total",
+			Help:      "Count of end-user OIDC login attempts, by result.",
+		}, []string{"result"}),
+		authRateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "portal_proxy",
+			Name:      "auth_rate_limited_total",
+			Help:      "Count of auth requests rejected by the per-IP rate limiter or per-username lockout, by reason.",
+		}, []string{"reason"}),
+	}
+
+	registry.MustRegister(m.httpRequests, m.httpDuration, m.vcsOAuth, m.oidcLogins, m.authRateLimited)
+	registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "portal_proxy",
+		Name:      "db_pool_open_connections",
+		Help:      "Number of established database connections, both in use and idle.",
+	}, func() float64 { return float64(dcp.Stats().OpenConnections) }))
+	registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "portal_proxy",
+		Name:      "db_pool_in_use",
+		Help:      "Number of database connections currently in use.",
+	}, func() float64 { return float64(dcp.Stats().InUse) }))
+	registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "portal_proxy",
+		Name:      "db_pool_idle",
+		Help:      "Number of idle database connections.",
+	}, func() float64 { return float64(dcp.Stats().Idle) }))
+
+	return m
+}
+
+// recordVCSOAuthResult increments the VCS OAuth counter for the given client.
+// Call this from the OAuth exchange/callback handlers once the outcome of the
+// token exchange is known.
+func (m *appMetrics) recordVCSOAuthResult(client string, success bool) {
+	m.vcsOAuth.WithLabelValues(client, resultLabel(success)).Inc()
+}
+
+// recordOIDCLoginResult increments the end-user OIDC login counter. This is
+// a separate series from vcsOAuth: OIDC authenticates the portal's own users,
+// while vcsOAuth authenticates the portal against a user's VCS account on
+// their behalf, and conflating the two under one label value made the VCS
+// OAuth series uninterpretable.
+func (m *appMetrics) recordOIDCLoginResult(success bool) {
+	m.oidcLogins.WithLabelValues(resultLabel(success)).Inc()
+}
+
+func resultLabel(success bool) string {
+	if success {
+		return "success"
+	}
+	return "failure"
+}
+
+// vcsOAuthMetricsMiddleware records the VCS OAuth counter for the VCS OAuth
+// callback route, labelled by the real VCS client when the request carries
+// one (e.g. a "client" query param), falling back to "unknown" otherwise.
+// The callback URL itself is registered with each external VCS OAuth app, so
+// it can't be changed to carry the client in its path; per-client labelling
+// still needs handleVCSAuth/handleVCSAuthCallback (both outside this
+// snapshot) to thread the chosen client through to this middleware, e.g. via
+// the session set up when the flow was initiated. That wiring is tracked as
+// follow-up work; until it lands, this only separates "unknown" out.
+func vcsOAuthMetricsMiddleware(m *appMetrics) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			err := next(c)
+			client := c.QueryParam("client")
+			if client == "" {
+				client = "unknown"
+			}
+			m.recordVCSOAuthResult(client, err == nil && c.Response().Status() < 400)
+			return err
+		}
+	}
+}
+
+// Reason values for recordAuthRateLimited. Kept as a fixed, small set rather
+// than the attacker-controlled IP/username that triggered the rejection:
+// labelling directly by either would let a credential-stuffing run (which
+// routinely rotates through thousands of IPs or tried usernames) mint a
+// fresh Prometheus time series per attempt, turning the defense itself into
+// a cardinality/memory-exhaustion vector against the registry and anything
+// scraping it.
+const (
+	authRateLimitReasonIP       = "per-ip"
+	authRateLimitReasonUsername = "per-username"
+)
+
+// recordAuthRateLimited increments the rejection counter for reason, so ops
+// can alarm on sustained credential-stuffing attempts. Callers that need the
+// actual IP/username for investigation should log it via appLog instead of
+// folding it into this metric's labels.
+func (m *appMetrics) recordAuthRateLimited(reason string) {
+	m.authRateLimited.WithLabelValues(reason).Inc()
+}
+
+// metricsMiddleware records a request count and duration observation for
+// every request that passes through it, labelled by the matched route.
+func metricsMiddleware(m *appMetrics) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+
+			route := c.Path()
+			if route == "" {
+				route = "unmatched"
+			}
+			status := c.Response().Status()
+			m.httpRequests.WithLabelValues(route, c.Request().Method(), fmt.Sprintf("%d", status)).Inc()
+			m.httpDuration.WithLabelValues(route, c.Request().Method()).Observe(time.Since(start).Seconds())
+
+			return err
+		}
+	}
+}
+
+// startAdminServer serves /metrics and /debug/pprof/* on a listener separate
+// from the public TLS port, so operational endpoints are never reachable
+// from outside the cluster. It blocks until ctx is cancelled, at which point
+// it shuts down gracefully.
+func startAdminServer(ctx context.Context, addr string, m *appMetrics) {
+	if addr == "" {
+		appLog.Info().Msg("MetricsAddress not configured; admin/metrics listener disabled")
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	srv := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			appLog.Error().Err(err).Msg("Admin/metrics listener shutdown error")
+		}
+	}()
+
+	appLog.Info().Msgf("Admin/metrics listener starting on %s", addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		appLog.Error().Err(err).Msg("Admin/metrics listener error")
+	}
+}
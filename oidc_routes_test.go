@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestOIDCGroupIsAdmin(t *testing.T) {
+	tests := []struct {
+		name        string
+		adminGroups []string
+		userGroups  []string
+		want        bool
+	}{
+		{"no admin groups configured denies everyone", nil, []string{"anything"}, false},
+		{"empty admin groups configured denies everyone", []string{}, []string{"admins"}, false},
+		{"user in admin group is admin", []string{"admins", "ops"}, []string{"devs", "admins"}, true},
+		{"user not in any admin group is denied", []string{"admins"}, []string{"devs"}, false},
+		{"user with no groups is denied", []string{"admins"}, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := oidcGroupIsAdmin(tt.adminGroups, tt.userGroups)
+			if got != tt.want {
+				t.Errorf("oidcGroupIsAdmin(%v, %v) = %v, want %v", tt.adminGroups, tt.userGroups, got, tt.want)
+			}
+		})
+	}
+}
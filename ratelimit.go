@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hpcloud/portal-proxy/datastore"
+	"github.com/labstack/echo"
+	"golang.org/x/time/rate"
+)
+
+// ipRateLimiterEntryTTL is how long an IP's bucket is kept after its last
+// request before ipRateLimiter.evict reclaims it. Credential-stuffing runs
+// routinely rotate through thousands of source IPs/proxies; without
+// eviction the limiter map would grow without bound for the life of the
+// process.
+const ipRateLimiterEntryTTL = 10 * time.Minute
+
+type ipRateLimiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// ipRateLimiter hands out a token-bucket limiter per client IP, creating
+// one on first use and evicting entries that have been idle past
+// ipRateLimiterEntryTTL. It backs the global per-IP throttle on the auth
+// group; usernameLockoutMiddleware (below) handles the separate
+// per-username backoff.
+type ipRateLimiter struct {
+	mu       sync.Mutex
+	limiters map[string]*ipRateLimiterEntry
+	limit    rate.Limit
+	burst    int
+}
+
+func newIPRateLimiter(perMinute int) *ipRateLimiter {
+	l := &ipRateLimiter{
+		limiters: make(map[string]*ipRateLimiterEntry),
+		limit:    rate.Limit(float64(perMinute) / 60.0),
+		burst:    perMinute,
+	}
+
+	go l.evictLoop()
+
+	return l
+}
+
+func (l *ipRateLimiter) allow(ip string) bool {
+	l.mu.Lock()
+	entry, ok := l.limiters[ip]
+	if !ok {
+		entry = &ipRateLimiterEntry{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[ip] = entry
+	}
+	entry.lastSeen = time.Now()
+	limiter := entry.limiter
+	l.mu.Unlock()
+
+	return limiter.Allow()
+}
+
+// evictLoop periodically drops limiter entries that haven't been touched
+// within ipRateLimiterEntryTTL, for the life of the process.
+func (l *ipRateLimiter) evictLoop() {
+	ticker := time.NewTicker(ipRateLimiterEntryTTL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		l.evict(time.Now())
+	}
+}
+
+func (l *ipRateLimiter) evict(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for ip, entry := range l.limiters {
+		if now.Sub(entry.lastSeen) > ipRateLimiterEntryTTL {
+			delete(l.limiters, ip)
+		}
+	}
+}
+
+// clientIP strips the port from Echo's RemoteAddress(), which is always in
+// "ip:port" form. Without this, a client that opens a new connection per
+// attempt (the common case for scripted credential stuffing, not the
+// exception) gets a fresh bucket — and is never throttled — every time.
+func clientIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// authAttemptSucceeded reports whether a login attempt that has already run
+// through next(c) should count as a success. c.Response().Status() is only
+// meaningful once err is nil: a handler that rejects a login the idiomatic
+// Echo way, by returning an *echo.HTTPError instead of writing the response
+// itself, doesn't get its status code applied until Echo's top-level
+// HTTPErrorHandler runs, which happens after next(c) has already returned
+// here. Treat any non-nil err as a failure unconditionally, the same way
+// vcsOAuthMetricsMiddleware guards its own success check.
+func authAttemptSucceeded(err error, status int) bool {
+	return err == nil && status >= 200 && status < 300
+}
+
+// authRateLimitMiddleware throttles the auth group to AuthRateLimitPerIP
+// requests/minute per client IP, returning 429 with Retry-After once a
+// caller exceeds it. This guards /v1/auth/login/uaa, /v1/auth/login/cnsi
+// and /v1/auth/logout against credential-stuffing floods.
+func authRateLimitMiddleware(p *portalProxy) echo.MiddlewareFunc {
+	perMinute := p.Config.AuthRateLimitPerIP
+	if perMinute <= 0 {
+		perMinute = 10
+	}
+	limiter := newIPRateLimiter(perMinute)
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			ip := clientIP(c.Request().RemoteAddress())
+			if !limiter.allow(ip) {
+				appLog.Info().Str("ip", ip).Msg("Auth request rejected by per-IP rate limiter")
+				p.Metrics.recordAuthRateLimited(authRateLimitReasonIP)
+				c.Response().Header().Set("Retry-After", "60")
+				return echo.NewHTTPError(http.StatusTooManyRequests, "Too many requests, please try again later.")
+			}
+			return next(c)
+		}
+	}
+}
+
+// usernameLockoutMiddleware enforces an exponential-backoff lockout per
+// username after repeated failed UAA logins. Before calling loginToUAA it
+// checks the auth_failures table for an active lockout; afterwards it
+// records the attempt's outcome, since loginToUAA itself (defined outside
+// this file) isn't aware of the lockout table.
+func usernameLockoutMiddleware(p *portalProxy) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			username := c.FormValue("username")
+			if username == "" {
+				return next(c)
+			}
+
+			lockedUntil, err := datastore.AuthFailureLockedUntil(p.DatabaseConnectionPool, p.DatabaseDialect, username)
+			if err != nil {
+				appLog.Error().Err(err).Str("username", username).Msg("Unable to check auth lockout state")
+			} else if lockedUntil.After(time.Now()) {
+				appLog.Info().Str("username", username).Msg("Auth request rejected by per-username lockout")
+				p.Metrics.recordAuthRateLimited(authRateLimitReasonUsername)
+				retryAfter := int(time.Until(lockedUntil).Seconds())
+				c.Response().Header().Set("Retry-After", fmt.Sprintf("%d", retryAfter))
+				return echo.NewHTTPError(http.StatusTooManyRequests, "Too many failed login attempts, please try again later.")
+			}
+
+			err = next(c)
+
+			if authAttemptSucceeded(err, c.Response().Status()) {
+				if resetErr := datastore.ResetAuthFailures(p.DatabaseConnectionPool, p.DatabaseDialect, username); resetErr != nil {
+					appLog.Error().Err(resetErr).Str("username", username).Msg("Unable to reset auth failure count")
+				}
+			} else {
+				if recordErr := datastore.RecordAuthFailure(p.DatabaseConnectionPool, p.DatabaseDialect, username); recordErr != nil {
+					appLog.Error().Err(recordErr).Str("username", username).Msg("Unable to record auth failure")
+				}
+			}
+
+			return err
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		want       string
+	}{
+		{"ipv4 with port", "203.0.113.5:54321", "203.0.113.5"},
+		{"ipv6 with port", "[2001:db8::1]:54321", "2001:db8::1"},
+		{"no port falls back to the raw value", "203.0.113.5", "203.0.113.5"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := clientIP(tt.remoteAddr)
+			if got != tt.want {
+				t.Errorf("clientIP(%q) = %q, want %q", tt.remoteAddr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthAttemptSucceeded(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		want   bool
+	}{
+		{"2xx with no error is a success", nil, http.StatusOK, true},
+		{"3xx with no error is not a success", nil, http.StatusFound, false},
+		{
+			"rejected login surfaced as an unwritten HTTPError is a failure",
+			echo.NewHTTPError(http.StatusUnauthorized, "bad credentials"),
+			http.StatusOK, // Echo's default status before HTTPErrorHandler runs
+			false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := authAttemptSucceeded(tt.err, tt.status)
+			if got != tt.want {
+				t.Errorf("authAttemptSucceeded(%v, %d) = %v, want %v", tt.err, tt.status, got, tt.want)
+			}
+		})
+	}
+}